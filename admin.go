@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// initAdmin starts the optional admin HTTP listener that lets operators
+// inspect and edit the auth subsystem without restarting COW: reload
+// file:// user tables, list/add/update/remove static:// users, and flush
+// the authed-IP cache. It mirrors frp's RunAdminServer in spirit.
+//
+// The listener is protected by its own Basic credential
+// (config.AdminUser/config.AdminPasswd) and, unless config.AdminAddr
+// explicitly names a non-loopback host, is bound to loopback only.
+func initAdmin() {
+	if config.AdminAddr == "" {
+		return
+	}
+
+	addr := config.AdminAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/reload", adminAuthed(handleAuthReload))
+	mux.HandleFunc("/auth/users", adminAuthed(handleAuthUsers))
+	mux.HandleFunc("/auth/users/", adminAuthed(handleAuthUser))
+	mux.HandleFunc("/auth/flush", adminAuthed(handleAuthFlush))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			Fatal("admin: listen on", addr, "failed:", err)
+		}
+	}()
+	debug.Println("admin: listening on", addr)
+}
+
+// adminAuthed wraps h to require config.AdminUser/config.AdminPasswd as
+// HTTP Basic credentials before running it.
+func adminAuthed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, passwd, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(config.AdminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(passwd), []byte(config.AdminPasswd)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cow admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAuthReload re-reads every file:// provider's user file.
+func handleAuthReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, p := range auth.fileProviders {
+		if err := p.reloadNow(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"reloaded": len(auth.fileProviders)})
+}
+
+// handleAuthUsers lists every configured user's name and port binding
+// across all static:// and file:// tables. No secrets are ever returned.
+func handleAuthUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type user struct {
+		Name string `json:"name"`
+		Port uint16 `json:"port"`
+	}
+	var users []user
+	for _, t := range auth.userTables {
+		for name, port := range t.listUsers() {
+			users = append(users, user{name, port})
+		}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// handleAuthUser handles PUT/DELETE on /auth/users/{name}, operating on
+// auth.adminUsers (the first static:// table). file:// tables are only
+// changed by editing their backing file, which POST /auth/reload picks up.
+func handleAuthUser(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/auth/users/"):]
+	if name == "" {
+		http.Error(w, "missing user name", http.StatusBadRequest)
+		return
+	}
+	if auth.adminUsers == nil {
+		http.Error(w, "no static:// auth provider configured to edit", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Password string `json:"password"`
+			Port     int    `json:"port"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("bad request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if body.Password == "" || body.Port < 0 || body.Port > 0xffff {
+			http.Error(w, "password required, port must be 0-65535", http.StatusBadRequest)
+			return
+		}
+		au := &authUser{passwd: body.Password, hashed: isBcryptHash(body.Password), port: uint16(body.Port)}
+		auth.adminUsers.setUser(name, au)
+		flushUsers([]string{name})
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !auth.adminUsers.deleteUser(name) {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		flushUsers([]string{name})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAuthFlush drops every cached authed IP, forcing all clients to
+// re-authenticate on their next request.
+func handleAuthFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Swap in a fresh, empty TimeoutSet under authedMu, which also covers
+	// config.AdminAddr enabled with no -auth provider configured (initAuth
+	// never ran, so auth.authed was nil until now).
+	auth.authedMu.Lock()
+	auth.authed = NewTimeoutSet(time.Duration(config.AuthTimeout) * time.Hour)
+	auth.authedMu.Unlock()
+	auth.authedUserMu.Lock()
+	auth.authedUser = make(map[string]string)
+	auth.authedUserMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"errors"
 	"fmt"
 	"net"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
-
-	"github.com/cyfdecyf/bufio"
 )
 
 const (
@@ -34,141 +31,107 @@ type netAddr struct {
 	mask net.IPMask
 }
 
-type authUser struct {
-	// user name is the key to auth.user, no need to store here
-	passwd string
-	ha1    string // used in request digest, initialized ondemand
-	port   uint16 // 0 means any port
+// AuthProvider authenticates a client connection against one auth backend,
+// selected at startup by the scheme of a -auth URI ("static://", "file://",
+// "cert://", "allow://"). Multiple -auth flags chain with OR semantics.
+type AuthProvider interface {
+	// Authenticate reports whether conn/r is authorized. It returns
+	// errAuthRequired (or errDigestUnsupported/errNonceStale) to fall
+	// through to the next provider, and must never write to conn itself;
+	// only Authenticate's fallthrough sends a challenge.
+	Authenticate(conn *clientConn, r *Request) error
+
+	// WantsDigest reports whether this provider should be challenged with
+	// Digest (true) rather than Basic (false) authentication.
+	WantsDigest() bool
+}
+
+// authProviderFactory builds an AuthProvider out of the remainder of a
+// -auth URI. Backends register a factory for their scheme in an init func.
+type authProviderFactory func(u *url.URL) (AuthProvider, error)
+
+var authProviderFactories = map[string]authProviderFactory{}
+
+func registerAuthProvider(scheme string, factory authProviderFactory) {
+	authProviderFactories[scheme] = factory
 }
 
 var auth struct {
 	required bool
 
-	user map[string]*authUser
+	providers []AuthProvider
 
-	allowedClient []netAddr
+	// authedMu guards the authed pointer itself (handleAuthFlush swaps it
+	// from an HTTP handler goroutine), not TimeoutSet's own locking.
+	authedMu sync.RWMutex
+	authed   *TimeoutSet // cache authenticated users based on ip
 
-	authed *TimeoutSet // cache authenticated users based on ip
+	// authedUserMu guards authedUser, a small ip->username index kept
+	// alongside authed so a credential change for one user (reload,
+	// admin API) can flush just that user's cached IPs instead of
+	// everyone's.
+	authedUserMu sync.Mutex
+	authedUser   map[string]string
 
-	template *template.Template
-}
+	// userTables lists every static:// and file:// user table in
+	// registration order, for the admin API's GET /auth/users. adminUsers
+	// is the first static:// table, the one PUT/DELETE /auth/users/{name}
+	// mutate; file:// tables are managed by editing their backing file and
+	// reloading, not through the admin API directly.
+	userTables []*userTableProvider
+	adminUsers *userTableProvider
 
-func (au *authUser) initHA1(user string) {
-	if au.ha1 == "" {
-		au.ha1 = md5sum(user + ":" + authRealm + ":" + au.passwd)
-	}
-}
+	// fileProviders lists every file:// provider, for the admin API's
+	// POST /auth/reload.
+	fileProviders []*fileAuthProvider
 
-func parseUserPasswd(userPasswd string) (user string, au *authUser, err error) {
-	arr := strings.Split(userPasswd, ":")
-	n := len(arr)
-	if n == 1 || n > 3 {
-		err = errors.New("user password: " + userPasswd +
-			" syntax wrong, should be username:password[:port]")
-		return
-	}
-	user, passwd := arr[0], arr[1]
-	if user == "" || passwd == "" {
-		err = errors.New("user password " + userPasswd +
-			" should not contain empty user name or password")
-		return "", nil, err
-	}
-	var port int
-	if n == 3 && arr[2] != "" {
-		port, err = strconv.Atoi(arr[2])
-		if err != nil || port <= 0 || port > 0xffff {
-			err = errors.New("user password: " + userPasswd + " invalid port")
-			return "", nil, err
-		}
-	}
-	au = &authUser{passwd, "", uint16(port)}
-	return user, au, nil
-}
-
-func parseAllowedClient(val string) {
-	if val == "" {
-		return
-	}
-	arr := strings.Split(val, ",")
-	auth.allowedClient = make([]netAddr, len(arr))
-	for i, v := range arr {
-		s := strings.TrimSpace(v)
-		ipAndMask := strings.Split(s, "/")
-		if len(ipAndMask) > 2 {
-			Fatal("allowedClient syntax error: client should be the form ip/nbitmask")
-		}
-		ip := net.ParseIP(ipAndMask[0])
-		if ip == nil {
-			Fatalf("allowedClient syntax error %s: ip address not valid\n", s)
-		}
-		var mask net.IPMask
-		if len(ipAndMask) == 2 {
-			nbit, err := strconv.Atoi(ipAndMask[1])
-			if err != nil {
-				Fatalf("allowedClient syntax error %s: %v\n", s, err)
-			}
-			if nbit > 32 {
-				Fatal("allowedClient error: mask number should <= 32")
-			}
-			mask = NewNbitIPv4Mask(nbit)
-		} else {
-			mask = NewNbitIPv4Mask(32)
-		}
-		auth.allowedClient[i] = netAddr{ip.Mask(mask), mask}
-	}
+	template *template.Template
 }
 
-func addUserPasswd(val string) {
-	if val == "" {
-		return
-	}
-	user, au, err := parseUserPasswd(val)
-	debug.Println("user:", user, "port:", au.port)
-	if err != nil {
-		Fatal(err)
-	}
-	if _, ok := auth.user[user]; ok {
-		Fatal("duplicate user:", user)
+// registerUserTable makes a static:// or file:// provider's user table
+// visible to the admin API. writable marks it as a candidate for
+// auth.adminUsers.
+func registerUserTable(t *userTableProvider, writable bool) {
+	auth.userTables = append(auth.userTables, t)
+	if writable && auth.adminUsers == nil {
+		auth.adminUsers = t
 	}
-	auth.user[user] = au
 }
 
-func loadUserPasswdFile(file string) {
-	if file == "" {
-		return
-	}
-	f, err := os.Open(file)
+// parseAuthURI turns one -auth flag value into an AuthProvider.
+func parseAuthURI(raw string) (AuthProvider, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		Fatal("error opening user passwd fle:", err)
+		return nil, fmt.Errorf("auth: invalid -auth value %q: %v", raw, err)
 	}
-
-	r := bufio.NewReader(f)
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		addUserPasswd(s.Text())
+	factory, ok := authProviderFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("auth: unknown auth scheme %q in %q", u.Scheme, raw)
 	}
-	f.Close()
+	return factory(u)
 }
 
 func initAuth() {
-	if config.UserPasswd != "" ||
-		config.UserPasswdFile != "" ||
-		config.AllowedClient != "" {
-		auth.required = true
-	} else {
+	if len(config.Auth) == 0 {
 		return
 	}
+	auth.required = true
 
-	auth.user = make(map[string]*authUser)
-
-	addUserPasswd(config.UserPasswd)
-	loadUserPasswdFile(config.UserPasswdFile)
-	parseAllowedClient(config.AllowedClient)
+	for _, raw := range config.Auth {
+		p, err := parseAuthURI(raw)
+		if err != nil {
+			Fatal(err)
+		}
+		auth.providers = append(auth.providers, p)
+	}
 
 	auth.authed = NewTimeoutSet(time.Duration(config.AuthTimeout) * time.Hour)
+	auth.authedUser = make(map[string]string)
 
 	rawTemplate := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
-		"Proxy-Authenticate: Digest realm=\"" + authRealm + "\", nonce=\"{{.Nonce}}\", qop=\"auth\"\r\n" +
+		"Proxy-Authenticate: {{if .Digest}}Digest realm=\"" + authRealm + "\", nonce=\"{{.Nonce}}\", " +
+		"opaque=\"{{.Opaque}}\", qop=\"auth\"{{if .Stale}}, stale=true{{end}}" +
+		"{{else}}Basic realm=\"" + authRealm + "\"{{end}}\r\n" +
 		"Content-Type: text/html\r\n" +
 		"Cache-Control: no-cache\r\n" +
 		"Content-Length: " + fmt.Sprintf("%d", len(authRawBodyTmpl)) + "\r\n\r\n" + authRawBodyTmpl
@@ -176,80 +139,147 @@ func initAuth() {
 	if auth.template, err = template.New("auth").Parse(rawTemplate); err != nil {
 		Fatal("internal error generating auth template:", err)
 	}
+
+	initNonce()
 }
 
-// Return err = nil if authentication succeed. nonce would be not empty if
-// authentication is needed, and should be passed back on subsequent call.
+// Return err = nil if authentication succeed. A single challenge is sent to
+// the client as a side effect if none of the configured providers
+// authenticate the request. A provider error other than errAuthRequired,
+// errDigestUnsupported or errNonceStale is returned at once: the remaining
+// providers are not tried and no challenge is sent.
 func Authenticate(conn *clientConn, r *Request) (err error) {
+	if !auth.required {
+		return nil
+	}
+
 	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	if auth.authed.has(clientIP) {
+	auth.authedMu.RLock()
+	authed := auth.authed
+	auth.authedMu.RUnlock()
+	if authed.has(clientIP) {
 		debug.Printf("%s has already authed\n", clientIP)
-		return
+		return nil
 	}
-	if authIP(clientIP) { // IP is allowed
-		return
+
+	digest, stale := wantsDigest(), false
+	err = errAuthRequired
+	var succeeded AuthProvider
+	for _, p := range auth.providers {
+		switch err = p.Authenticate(conn, r); err {
+		case nil:
+			succeeded = p
+		case errAuthRequired:
+			continue
+		case errDigestUnsupported:
+			// Can't verify a bcrypt-hashed password against a Digest
+			// response; challenge for Basic instead.
+			digest = false
+			continue
+		case errNonceStale:
+			// Client nonce expired or exhausted its nc range; have it
+			// silently retry with a fresh one rather than re-prompting.
+			stale = true
+			continue
+		default:
+			return err
+		}
+		break
 	}
-	err = authUserPasswd(conn, r)
 	if err == nil {
-		auth.authed.add(clientIP)
+		// cert:// connections are re-verified on every request instead of
+		// being cached by IP, so a renegotiated session can't coast on an
+		// earlier certificate check.
+		if _, certAuthed := succeeded.(*certAuthProvider); !certAuthed {
+			authed.add(clientIP)
+		}
+		return nil
 	}
-	return
+	return sendAuthChallenge(conn, digest, stale)
+}
+
+// rememberAuthedUser records which user authenticated a given client IP, so
+// a later credential change for that user can selectively flush it.
+func rememberAuthedUser(conn *clientConn, user string) {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	auth.authedUserMu.Lock()
+	auth.authedUser[clientIP] = user
+	auth.authedUserMu.Unlock()
 }
 
-// authIP checks whether the client ip address matches one in allowedClient.
-// It uses a sequential search.
-func authIP(clientIP string) bool {
-	ip := net.ParseIP(clientIP)
-	if ip == nil {
-		panic("authIP should always get IP address")
+// flushUsers drops the authed-IP cache entry for every client currently
+// cached under one of the given user names, forcing them to re-authenticate
+// on their next request. Used after a user is removed or its password
+// changes, e.g. on file:// reload or via the admin API.
+func flushUsers(users []string) {
+	if len(users) == 0 {
+		return
 	}
+	auth.authedMu.RLock()
+	authed := auth.authed
+	auth.authedMu.RUnlock()
+	if authed == nil {
+		return
+	}
+	stale := make(map[string]bool, len(users))
+	for _, u := range users {
+		stale[u] = true
+	}
+	auth.authedUserMu.Lock()
+	defer auth.authedUserMu.Unlock()
+	for ip, user := range auth.authedUser {
+		if stale[user] {
+			authed.del(ip)
+			delete(auth.authedUser, ip)
+		}
+	}
+}
 
-	for _, na := range auth.allowedClient {
-		if ip.Mask(na.mask).Equal(na.ip) {
-			debug.Printf("client ip %s allowed\n", clientIP)
+// wantsDigest reports whether the client should be challenged with Digest
+// rather than Basic authentication, based on the configured providers.
+func wantsDigest() bool {
+	for _, p := range auth.providers {
+		if p.WantsDigest() {
 			return true
 		}
 	}
 	return false
 }
 
-func genNonce() string {
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "%x", time.Now().Unix())
-	return buf.String()
-}
-
-func calcRequestDigest(kv map[string]string, ha1, method string) string {
-	// Refer to rfc2617 section 3.2.2.1 Request-Digest
-	arr := []string{
-		ha1,
-		kv["nonce"],
-		kv["nc"],
-		kv["cnonce"],
-		"auth",
-		md5sum(method + ":" + kv["uri"]),
+// sendAuthChallenge writes a 407 response challenging the client for Basic
+// or Digest credentials and returns errAuthRequired, the sentinel callers
+// use to know a challenge (rather than a hard failure) happened. stale is
+// only meaningful for Digest: it tells the client to silently retry with a
+// fresh nonce instead of re-prompting the user for credentials.
+func sendAuthChallenge(conn *clientConn, digest, stale bool) error {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	opaque := genOpaque()
+	data := struct {
+		Digest bool
+		Stale  bool
+		Nonce  string
+		Opaque string
+	}{
+		digest,
+		stale,
+		genNonce(clientIP, opaque),
+		opaque,
 	}
-	return md5sum(strings.Join(arr, ":"))
-}
-
-func checkProxyAuthorization(conn *clientConn, r *Request) error {
-	if debug {
-		debug.Printf("cli(%s) authorization: %s\n", conn.RemoteAddr(), r.ProxyAuthorization)
+	buf := new(bytes.Buffer)
+	if err := auth.template.Execute(buf, data); err != nil {
+		return fmt.Errorf("auth: error generating challenge: %v", err)
 	}
-
-	arr := strings.SplitN(r.ProxyAuthorization, " ", 2)
-	if len(arr) != 2 {
-		return errors.New("auth: malformed ProxyAuthorization header: " + r.ProxyAuthorization)
+	if bool(debug) && verbose {
+		debug.Printf("authorization response:\n%s", buf.String())
 	}
-	authMethod := strings.ToLower(strings.TrimSpace(arr[0]))
-	if authMethod == "digest" {
-		return authDigest(conn, r, arr[1])
-	} else if authMethod == "basic" {
-		return authBasic(conn, arr[1])
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("auth: send challenge error: %v", err)
 	}
-	return errors.New("auth: method " + arr[0] + " unsupported, must use digest")
+	return errAuthRequired
 }
 
+// authPort checks that the connection was accepted on the port the user is
+// restricted to, if any.
 func authPort(conn *clientConn, user string, au *authUser) error {
 	if au.port == 0 {
 		return nil
@@ -263,95 +293,15 @@ func authPort(conn *clientConn, user string, au *authUser) error {
 	return nil
 }
 
-func authBasic(conn *clientConn, userPasswd string) error {
-	b64, err := base64.StdEncoding.DecodeString(userPasswd)
-	if err != nil {
-		return errors.New("auth:" + err.Error())
-	}
-	arr := strings.Split(string(b64), ":")
-	if len(arr) != 2 {
-		return errors.New("auth: malformed basic auth user:passwd")
-	}
-	user := arr[0]
-	passwd := arr[1]
-
-	au, ok := auth.user[user]
-	if !ok || au.passwd != passwd {
-		return errAuthRequired
-	}
-	return authPort(conn, user, au)
-}
-
-func authDigest(conn *clientConn, r *Request, keyVal string) error {
-	authHeader := parseKeyValueList(keyVal)
-	if len(authHeader) == 0 {
-		return errors.New("auth: empty authorization list")
-	}
-	nonceTime, err := strconv.ParseInt(authHeader["nonce"], 16, 64)
-	if err != nil {
-		return fmt.Errorf("auth: nonce %v", err)
-	}
-	// If nonce time too early, reject. iOS will create a new connection to do
-	// authentication.
-	if time.Now().Sub(time.Unix(nonceTime, 0)) > time.Minute {
-		return errAuthRequired
-	}
-
-	user := authHeader["username"]
-	au, ok := auth.user[user]
-	if !ok {
-		errl.Printf("cli(%s) auth: no such user: %s\n", conn.RemoteAddr(), authHeader["username"])
-		return errAuthRequired
-	}
-
-	if err = authPort(conn, user, au); err != nil {
-		return err
-	}
-	if authHeader["qop"] != "auth" {
-		return errors.New("auth: qop wrong: " + authHeader["qop"])
-	}
-	response, ok := authHeader["response"]
-	if !ok {
-		return errors.New("auth: no request-digest response")
-	}
-
-	au.initHA1(user)
-	digest := calcRequestDigest(authHeader, au.ha1, r.Method)
-	if response != digest {
-		errl.Printf("cli(%s) auth: digest not match, maybe password wrong", conn.RemoteAddr())
-		return errAuthRequired
-	}
-	return nil
-}
-
-func authUserPasswd(conn *clientConn, r *Request) (err error) {
-	if r.ProxyAuthorization != "" {
-		// client has sent authorization header
-		err = checkProxyAuthorization(conn, r)
-		if err == nil {
-			return
-		} else if err != errAuthRequired {
-			sendErrorPage(conn, statusBadReq, "Bad authorization request", err.Error())
-			return
-		}
-		// auth required to through the following
-	}
-
-	nonce := genNonce()
-	data := struct {
-		Nonce string
-	}{
-		nonce,
-	}
-	buf := new(bytes.Buffer)
-	if err := auth.template.Execute(buf, data); err != nil {
-		return fmt.Errorf("error generating auth response: %v", err)
-	}
-	if bool(debug) && verbose {
-		debug.Printf("authorization response:\n%s", buf.String())
-	}
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("send auth response error: %v", err)
+func calcRequestDigest(kv map[string]string, ha1, method string) string {
+	// Refer to rfc2617 section 3.2.2.1 Request-Digest
+	arr := []string{
+		ha1,
+		kv["nonce"],
+		kv["nc"],
+		kv["cnonce"],
+		"auth",
+		md5sum(method + ":" + kv["uri"]),
 	}
-	return errAuthRequired
+	return md5sum(strings.Join(arr, ":"))
 }
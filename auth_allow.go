@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// allowAuthProvider implements the "allow://" scheme: clients whose source
+// IP falls in one of the configured networks are authenticated with no
+// credentials at all, e.g. -auth "allow://?net=127.0.0.1&net=10.0.0.0/8".
+type allowAuthProvider struct {
+	nets []netAddr
+}
+
+func newAllowAuthProvider(u *url.URL) (AuthProvider, error) {
+	nets := u.Query()["net"]
+	if len(nets) == 0 {
+		return nil, errors.New("auth: allow: requires at least one net= parameter")
+	}
+	p := &allowAuthProvider{}
+	for _, s := range nets {
+		na, err := parseNetAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		p.nets = append(p.nets, na)
+	}
+	return p, nil
+}
+
+func parseNetAddr(s string) (netAddr, error) {
+	s = strings.TrimSpace(s)
+	ipAndMask := strings.Split(s, "/")
+	if len(ipAndMask) > 2 {
+		return netAddr{}, fmt.Errorf("auth: allow: net %q: should be of the form ip/nbitmask", s)
+	}
+	ip := net.ParseIP(ipAndMask[0])
+	if ip == nil {
+		return netAddr{}, fmt.Errorf("auth: allow: net %q: ip address not valid", s)
+	}
+	mask := NewNbitIPv4Mask(32)
+	if len(ipAndMask) == 2 {
+		nbit, err := strconv.Atoi(ipAndMask[1])
+		if err != nil || nbit > 32 {
+			return netAddr{}, fmt.Errorf("auth: allow: net %q: mask number should <= 32", s)
+		}
+		mask = NewNbitIPv4Mask(nbit)
+	}
+	return netAddr{ip.Mask(mask), mask}, nil
+}
+
+func (p *allowAuthProvider) WantsDigest() bool {
+	return false
+}
+
+// authIP checks whether the client ip address matches one of p.nets. It
+// uses a sequential search.
+func (p *allowAuthProvider) authIP(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		panic("authIP should always get IP address")
+	}
+	for _, na := range p.nets {
+		if ip.Mask(na.mask).Equal(na.ip) {
+			debug.Printf("client ip %s allowed\n", clientIP)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *allowAuthProvider) Authenticate(conn *clientConn, r *Request) error {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if p.authIP(clientIP) {
+		return nil
+	}
+	return errAuthRequired
+}
+
+func init() {
+	registerAuthProvider("allow", newAllowAuthProvider)
+}
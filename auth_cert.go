@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+)
+
+// certAuthProvider implements the "cert://" scheme: clients are
+// authenticated by the mTLS client certificate presented on the proxy
+// listener (see config.ListenTLS, config.TLSCert, config.TLSKey and
+// config.ClientCA, and NewProxyTLSConfig below), matched against a static
+// user table. A successful match both authenticates the connection and
+// selects the authUser for the authPort check; if there's no matching
+// certificate, Authenticate falls through so Basic/Digest providers still
+// work on the same listener for clients without a client cert.
+type certAuthProvider struct {
+	user map[string]*authUser
+}
+
+func newCertAuthProvider(u *url.URL) (AuthProvider, error) {
+	p := &certAuthProvider{user: make(map[string]*authUser)}
+	for _, upw := range u.Query()["u"] {
+		user, au, err := parseUserPasswd(upw)
+		if err != nil {
+			return nil, err
+		}
+		p.user[user] = au
+	}
+	return p, nil
+}
+
+func (p *certAuthProvider) WantsDigest() bool {
+	return false
+}
+
+// Authenticate matches the verified leaf certificate's CN and DNS/email
+// SANs against p.user. Cert-auth connections are intentionally kept out of
+// the shared authed-IP cache (see Authenticate's skip of certAuthProvider)
+// so a renegotiated session is re-verified rather than trusted forever.
+func (p *certAuthProvider) Authenticate(conn *clientConn, r *Request) error {
+	state, ok := conn.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return errAuthRequired
+	}
+	leaf := state.VerifiedChains[0][0]
+
+	names := make([]string, 0, 1+len(leaf.DNSNames)+len(leaf.EmailAddresses))
+	names = append(names, leaf.Subject.CommonName)
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+
+	for _, name := range names {
+		au, ok := p.user[name]
+		if !ok {
+			continue
+		}
+		if err := authPort(conn, name, au); err != nil {
+			return err
+		}
+		debug.Printf("cli(%s) auth: cert matched user %s\n", conn.RemoteAddr(), name)
+		return nil
+	}
+	return errAuthRequired
+}
+
+func init() {
+	registerAuthProvider("cert", newCertAuthProvider)
+}
+
+// NewProxyTLSConfig builds the *tls.Config the proxy listener uses when
+// config.ListenTLS is set: it always presents config.TLSCert/config.TLSKey
+// and, when config.ClientCA is set, verifies client certificates against it
+// (without requiring one, so non-cert clients still complete the handshake
+// and fall through to Basic/Digest).
+func NewProxyTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("auth: cert: error loading proxy TLS cert/key: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("auth: cert: error reading client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("auth: cert: no certificates found in %s", config.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// WrapProxyListener wraps ln for mTLS termination when config.ListenTLS is
+// set, using NewProxyTLSConfig, and returns ln unchanged otherwise. The
+// proxy's accept loop must call this around its listener for cert:// to ever
+// see a verified client certificate.
+func WrapProxyListener(ln net.Listener) (net.Listener, error) {
+	if !config.ListenTLS {
+		return ln, nil
+	}
+	cfg, err := NewProxyTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg), nil
+}
+
+// TLSConnectionState reports the verified TLS state of conn's underlying
+// connection, and whether it's a TLS connection at all.
+func (c *clientConn) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+// defaultAuthReload is how often a file:// provider re-stats its user file
+// when config.AuthReload is left at its zero value.
+const defaultAuthReload = 15 * time.Second
+
+// fileAuthProvider implements the "file://" scheme: users are loaded from
+// an external htpasswd-style file, one "username:password[:port]" per
+// line, e.g. -auth "file:///etc/cow/htpasswd". The file is watched for
+// changes and reloaded without restarting COW.
+type fileAuthProvider struct {
+	userTableProvider
+	path string
+
+	// statMu guards modTime/size, read by the watcher goroutine and
+	// written from both it and the admin API's POST /auth/reload.
+	statMu  sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+func newFileAuthProvider(u *url.URL) (AuthProvider, error) {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("auth: file: %q missing a file path", u.String())
+	}
+
+	p := &fileAuthProvider{
+		userTableProvider: userTableProvider{name: "file"},
+		path:              path,
+	}
+	if _, err := p.load(); err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	p.digest = q.Get("digest") != "false"
+
+	registerUserTable(&p.userTableProvider, false)
+	auth.fileProviders = append(auth.fileProviders, p)
+
+	p.startWatch()
+	return p, nil
+}
+
+// reloadNow re-reads p.path immediately, regardless of whether its mtime or
+// size actually changed, and flushes the authed-IP cache for any user the
+// reload dropped or changed the credential of. Used by the admin API's
+// POST /auth/reload.
+func (p *fileAuthProvider) reloadNow() error {
+	changed, err := p.load()
+	if err != nil {
+		return err
+	}
+	flushUsers(changed)
+	return nil
+}
+
+// load reads p.path into a fresh user map and swaps it in under
+// userTableProvider's lock, so a failed reload never clobbers a working
+// table and a password change never leaves a stale cached ha1 behind (the
+// old *authUser carrying it is simply discarded). It reports the users that
+// are gone after the swap or whose credential changed.
+func (p *fileAuthProvider) load() ([]string, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: file: error opening user passwd file: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("auth: file: error stating user passwd file: %v", err)
+	}
+
+	user := make(map[string]*authUser)
+	r := bufio.NewReader(f)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		name, au, err := parseUserPasswd(line)
+		if err != nil {
+			return nil, err
+		}
+		user[name] = au
+	}
+
+	changed := p.setUsers(user)
+	p.statMu.Lock()
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+	p.statMu.Unlock()
+	return changed, nil
+}
+
+// startWatch launches the goroutine that periodically stats p.path and
+// reloads it on change. config.AuthReload is the poll interval in seconds;
+// 0 means defaultAuthReload, negative disables watching entirely.
+func (p *fileAuthProvider) startWatch() {
+	if config.AuthReload < 0 {
+		return
+	}
+	interval := defaultAuthReload
+	if config.AuthReload > 0 {
+		interval = time.Duration(config.AuthReload) * time.Second
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			p.maybeReload()
+		}
+	}()
+}
+
+func (p *fileAuthProvider) maybeReload() {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		errl.Printf("auth: file: can't stat %s: %v\n", p.path, err)
+		return
+	}
+	p.statMu.Lock()
+	unchanged := fi.ModTime().Equal(p.modTime) && fi.Size() == p.size
+	p.statMu.Unlock()
+	if unchanged {
+		return
+	}
+	changed, err := p.load()
+	if err != nil {
+		errl.Printf("auth: file: reload %s failed, keeping old table: %v\n", p.path, err)
+		return
+	}
+	flushUsers(changed)
+	debug.Println("auth: file: reloaded", p.path)
+}
+
+func init() {
+	registerAuthProvider("file", newFileAuthProvider)
+}
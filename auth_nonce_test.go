@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestNonceTrackerCheckAndAdvance(t *testing.T) {
+	t.Run("accepts a strictly increasing nc", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		if !nt.checkAndAdvance("nonce1", "alice", 1) {
+			t.Fatal("want first nc accepted")
+		}
+		if !nt.checkAndAdvance("nonce1", "alice", 2) {
+			t.Fatal("want increasing nc accepted")
+		}
+	})
+
+	t.Run("rejects a replayed nc", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		nt.checkAndAdvance("nonce1", "alice", 5)
+		if nt.checkAndAdvance("nonce1", "alice", 5) {
+			t.Fatal("replayed nc should be rejected")
+		}
+	})
+
+	t.Run("rejects nc going backwards", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		nt.checkAndAdvance("nonce1", "alice", 5)
+		if nt.checkAndAdvance("nonce1", "alice", 3) {
+			t.Fatal("nc going backwards should be rejected")
+		}
+	})
+
+	t.Run("rejects nc zero", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		if nt.checkAndAdvance("nonce1", "alice", 0) {
+			t.Fatal("nc=0 should be rejected")
+		}
+	})
+
+	t.Run("rejects nc past the configured cap", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		if nt.checkAndAdvance("nonce1", "alice", defaultNonceMaxNC+1) {
+			t.Fatal("nc beyond the cap should be rejected")
+		}
+	})
+
+	t.Run("tracks (nonce, user) pairs independently", func(t *testing.T) {
+		nt := newNonceTracker(4)
+		if !nt.checkAndAdvance("nonce1", "alice", 5) {
+			t.Fatal("want accepted")
+		}
+		if !nt.checkAndAdvance("nonce1", "bob", 1) {
+			t.Fatal("a different user under the same nonce should track separately")
+		}
+		if !nt.checkAndAdvance("nonce2", "alice", 1) {
+			t.Fatal("a different nonce for the same user should track separately")
+		}
+	})
+
+	t.Run("evicts the oldest entry past capacity", func(t *testing.T) {
+		nt := newNonceTracker(2)
+		nt.checkAndAdvance("n1", "alice", 1)
+		nt.checkAndAdvance("n2", "alice", 1)
+		nt.checkAndAdvance("n3", "alice", 1) // evicts n1
+
+		if got := len(nt.entries); got != 2 {
+			t.Fatalf("want 2 tracked entries, got %d", got)
+		}
+		if _, ok := nt.entries["n1:alice"]; ok {
+			t.Fatal("n1 should have been evicted")
+		}
+		// n1's high-water mark is gone, so nc=1 is accepted again.
+		if !nt.checkAndAdvance("n1", "alice", 1) {
+			t.Fatal("want evicted nonce's nc counter to have reset")
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// staticAuthProvider implements the "static://" scheme: users are listed
+// inline in the -auth URI itself, e.g.
+//
+//	-auth "static://?u=alice:secret&u=bob:secret:8080"
+//
+// This is the original flat username:password[:port] behavior.
+type staticAuthProvider struct {
+	userTableProvider
+}
+
+func newStaticAuthProvider(u *url.URL) (AuthProvider, error) {
+	p := &staticAuthProvider{userTableProvider{
+		name: "static",
+		user: make(map[string]*authUser),
+	}}
+
+	q := u.Query()
+	p.digest = q.Get("digest") != "false"
+	for _, upw := range q["u"] {
+		user, au, err := parseUserPasswd(upw)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.user[user]; ok {
+			return nil, fmt.Errorf("auth: static: duplicate user %s", user)
+		}
+		p.user[user] = au
+	}
+	if len(p.user) == 0 {
+		return nil, fmt.Errorf("auth: static: no users configured in %q", u.String())
+	}
+	registerUserTable(&p.userTableProvider, true)
+	return p, nil
+}
+
+func init() {
+	registerAuthProvider("static", newStaticAuthProvider)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authUser is one entry in a static/file-backed user table. passwd is
+// either a plaintext secret or, when hashed is true, a bcrypt hash as
+// produced by `htpasswd -bBC 4` (detected by its "$2a$"/"$2b$"/"$2y$"
+// prefix).
+type authUser struct {
+	// user name is the key to the owning provider's user map, no need to
+	// store here
+	passwd string
+	hashed bool
+	ha1    string // used in request digest, initialized ondemand for plaintext users
+	port   uint16 // 0 means any port
+}
+
+// errDigestUnsupported is returned by authDigest when the matched user's
+// password is bcrypt-hashed: Digest needs the password in the clear to
+// compute HA1, which a bcrypt hash can never give back.
+var errDigestUnsupported = errors.New("auth: digest auth unsupported for bcrypt-hashed password")
+
+func isBcryptHash(passwd string) bool {
+	return strings.HasPrefix(passwd, "$2a$") ||
+		strings.HasPrefix(passwd, "$2b$") ||
+		strings.HasPrefix(passwd, "$2y$")
+}
+
+func (au *authUser) initHA1(user string) {
+	if au.ha1 == "" {
+		au.ha1 = md5sum(user + ":" + authRealm + ":" + au.passwd)
+	}
+}
+
+// samePasswd reports whether au and other authenticate the same way,
+// ignoring ha1 which is just a cache derived from passwd.
+func (au *authUser) samePasswd(other *authUser) bool {
+	return au.passwd == other.passwd && au.hashed == other.hashed && au.port == other.port
+}
+
+// parseUserPasswd parses a single "username:password[:port]" line as found
+// in a -auth static:// URI or a file:// user passwd file. password may be
+// plaintext (backward compatible) or a bcrypt hash. Only the first colon
+// (user/password separator) and, if present, one trailing colon (the
+// optional port) are significant, so a bcrypt hash containing colons would
+// not be misparsed.
+func parseUserPasswd(userPasswd string) (user string, au *authUser, err error) {
+	sep := strings.Index(userPasswd, ":")
+	if sep < 0 {
+		err = errors.New("user password: " + userPasswd +
+			" syntax wrong, should be username:password[:port]")
+		return
+	}
+	user, rest := userPasswd[:sep], userPasswd[sep+1:]
+
+	passwd := rest
+	var port int
+	if lastSep := strings.LastIndex(rest, ":"); lastSep >= 0 {
+		if p, perr := strconv.Atoi(rest[lastSep+1:]); perr == nil && p > 0 && p <= 0xffff {
+			passwd = rest[:lastSep]
+			port = p
+		}
+	}
+	if user == "" || passwd == "" {
+		err = errors.New("user password " + userPasswd +
+			" should not contain empty user name or password")
+		return "", nil, err
+	}
+	au = &authUser{passwd: passwd, hashed: isBcryptHash(passwd), port: uint16(port)}
+	return user, au, nil
+}
+
+// userTableProvider implements the Basic/Digest verification shared by the
+// static:// and file:// auth providers: both just differ in how their
+// name->authUser table is populated. file:// rebuilds and swaps the table
+// at runtime (see its reload watcher), so all reads of user go through mu.
+type userTableProvider struct {
+	name   string // "static" or "file", used in log messages
+	digest bool   // challenge with Digest rather than Basic
+
+	mu   sync.RWMutex
+	user map[string]*authUser
+}
+
+func (p *userTableProvider) WantsDigest() bool {
+	return p.digest
+}
+
+// lookup fetches a user's table entry, safe for concurrent use with a
+// reload swapping p.user out from under it.
+func (p *userTableProvider) lookup(user string) (*authUser, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	au, ok := p.user[user]
+	return au, ok
+}
+
+// setUsers atomically swaps in a freshly loaded user table and reports the
+// names of users that need their authed-IP cache flushed: those removed
+// entirely and those whose credentials changed, so a reload can't leave a
+// client coasting on a stale password or port restriction.
+func (p *userTableProvider) setUsers(user map[string]*authUser) (changed []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, old := range p.user {
+		if new, ok := user[name]; !ok || !old.samePasswd(new) {
+			changed = append(changed, name)
+		}
+	}
+	p.user = user
+	return changed
+}
+
+// setUser adds or updates a single entry, for the admin API's
+// PUT /auth/users/{name}.
+func (p *userTableProvider) setUser(name string, au *authUser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user[name] = au
+}
+
+// deleteUser removes an entry, for the admin API's
+// DELETE /auth/users/{name}. It reports whether the user existed.
+func (p *userTableProvider) deleteUser(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.user[name]; !ok {
+		return false
+	}
+	delete(p.user, name)
+	return true
+}
+
+// listUsers returns a name->port snapshot, for the admin API's
+// GET /auth/users. It never exposes passwd/ha1.
+func (p *userTableProvider) listUsers() map[string]uint16 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]uint16, len(p.user))
+	for name, au := range p.user {
+		out[name] = au.port
+	}
+	return out
+}
+
+// Authenticate never writes to conn; see AuthProvider.Authenticate.
+func (p *userTableProvider) Authenticate(conn *clientConn, r *Request) error {
+	if r.ProxyAuthorization == "" {
+		return errAuthRequired
+	}
+
+	arr := strings.SplitN(r.ProxyAuthorization, " ", 2)
+	if len(arr) != 2 {
+		return errors.New("auth: malformed ProxyAuthorization header: " + r.ProxyAuthorization)
+	}
+	switch strings.ToLower(strings.TrimSpace(arr[0])) {
+	case "digest":
+		return p.authDigest(conn, r, arr[1])
+	case "basic":
+		return p.authBasic(conn, arr[1])
+	}
+	return errors.New("auth: method " + arr[0] + " unsupported, must use basic or digest")
+}
+
+func (p *userTableProvider) authBasic(conn *clientConn, userPasswd string) error {
+	b64, err := base64.StdEncoding.DecodeString(userPasswd)
+	if err != nil {
+		return errors.New("auth:" + err.Error())
+	}
+	arr := strings.SplitN(string(b64), ":", 2)
+	if len(arr) != 2 {
+		return errors.New("auth: malformed basic auth user:passwd")
+	}
+	user, passwd := arr[0], arr[1]
+
+	au, ok := p.lookup(user)
+	if !ok {
+		return errAuthRequired
+	}
+	if au.hashed {
+		if bcrypt.CompareHashAndPassword([]byte(au.passwd), []byte(passwd)) != nil {
+			return errAuthRequired
+		}
+	} else if subtle.ConstantTimeCompare([]byte(au.passwd), []byte(passwd)) != 1 {
+		return errAuthRequired
+	}
+	if err := authPort(conn, user, au); err != nil {
+		return err
+	}
+	rememberAuthedUser(conn, user)
+	return nil
+}
+
+func (p *userTableProvider) authDigest(conn *clientConn, r *Request, keyVal string) error {
+	authHeader := parseKeyValueList(keyVal)
+	if len(authHeader) == 0 {
+		return errors.New("auth: empty authorization list")
+	}
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	nonce := authHeader["nonce"]
+	nonceTime, ok := verifyNonce(nonce, clientIP, authHeader["opaque"])
+	if !ok {
+		errl.Printf("cli(%s) auth: forged or malformed nonce\n", conn.RemoteAddr())
+		return errAuthRequired
+	}
+	// If nonce time too early, reject with stale=true so the client
+	// transparently retries instead of re-prompting the user. iOS will
+	// create a new connection to do authentication.
+	if time.Now().Sub(time.Unix(nonceTime, 0)) > time.Minute {
+		return errNonceStale
+	}
+
+	user := authHeader["username"]
+	au, ok := p.lookup(user)
+	if !ok {
+		errl.Printf("cli(%s) auth: no such user: %s\n", conn.RemoteAddr(), user)
+		return errAuthRequired
+	}
+
+	if au.hashed {
+		return errDigestUnsupported
+	}
+
+	if err := authPort(conn, user, au); err != nil {
+		return err
+	}
+	if authHeader["qop"] != "auth" {
+		return errors.New("auth: qop wrong: " + authHeader["qop"])
+	}
+	response, ok := authHeader["response"]
+	if !ok {
+		return errors.New("auth: no request-digest response")
+	}
+
+	nc, err := strconv.ParseUint(authHeader["nc"], 16, 64)
+	if err != nil {
+		return errors.New("auth: nc not valid hex: " + authHeader["nc"])
+	}
+	if !nonceReplay.checkAndAdvance(nonce, user, nc) {
+		return errNonceStale
+	}
+
+	au.initHA1(user)
+	digest := calcRequestDigest(authHeader, au.ha1, r.Method)
+	if response != digest {
+		errl.Printf("cli(%s) auth: digest not match, maybe password wrong", conn.RemoteAddr())
+		return errAuthRequired
+	}
+	rememberAuthedUser(conn, user)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseUserPasswd(t *testing.T) {
+	const bcryptHash = "$2a$10$N9qo8uLOickgx2ZMRZoHyetjpuH7LqG3h9zMWfg90TBTpj7gV.RK6"
+
+	tests := []struct {
+		name       string
+		input      string
+		wantUser   string
+		wantPasswd string
+		wantHashed bool
+		wantPort   uint16
+		wantErr    bool
+	}{
+		{"plain, no port", "alice:secret", "alice", "secret", false, 0, false},
+		{"plain, with port", "alice:secret:8080", "alice", "secret", false, 8080, false},
+		{"bcrypt hash, no port", "alice:" + bcryptHash, "alice", bcryptHash, true, 0, false},
+		{"bcrypt hash, with port", "alice:" + bcryptHash + ":8080", "alice", bcryptHash, true, 8080, false},
+		{"trailing colon that isn't a port stays part of passwd", "alice:pass:word", "alice", "pass:word", false, 0, false},
+		{"port out of range stays part of passwd", "alice:secret:70000", "alice", "secret:70000", false, 0, false},
+		{"missing colon", "aliceonly", "", "", false, 0, true},
+		{"empty user", ":secret", "", "", false, 0, true},
+		{"empty password", "alice:", "", "", false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, au, err := parseUserPasswd(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if user != tt.wantUser {
+				t.Errorf("user = %q, want %q", user, tt.wantUser)
+			}
+			if au.passwd != tt.wantPasswd {
+				t.Errorf("passwd = %q, want %q", au.passwd, tt.wantPasswd)
+			}
+			if au.hashed != tt.wantHashed {
+				t.Errorf("hashed = %v, want %v", au.hashed, tt.wantHashed)
+			}
+			if au.port != tt.wantPort {
+				t.Errorf("port = %d, want %d", au.port, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestAuthUserSamePasswd(t *testing.T) {
+	a := &authUser{passwd: "secret", hashed: false, port: 8080}
+	same := &authUser{passwd: "secret", hashed: false, port: 8080}
+	if !a.samePasswd(same) {
+		t.Error("identical passwd/hashed/port should compare equal")
+	}
+
+	diffPasswd := &authUser{passwd: "other", hashed: false, port: 8080}
+	if a.samePasswd(diffPasswd) {
+		t.Error("different passwd should not compare equal")
+	}
+
+	diffPort := &authUser{passwd: "secret", hashed: false, port: 8081}
+	if a.samePasswd(diffPort) {
+		t.Error("different port should not compare equal")
+	}
+}